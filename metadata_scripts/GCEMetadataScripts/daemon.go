@@ -0,0 +1,205 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+)
+
+const daemonWaitTimeout = 60 * time.Second
+
+// stateFile is where the daemon persists the last-seen content hash of each
+// startup script, so that a restart doesn't re-run scripts that haven't
+// changed.
+func stateFile() string {
+	return filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "metadata-scripts-state.json")
+}
+
+// loadState reads the persisted script-name to content-hash map, returning
+// an empty map if the file doesn't exist yet.
+func loadState() (map[string]string, error) {
+	state := map[string]string{}
+	data, err := ioutil.ReadFile(stateFile())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// saveState persists the script-name to content-hash map.
+func saveState(state map[string]string) error {
+	path := stateFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// hashContent returns a hex-encoded sha256 hash of content, used to detect
+// whether a script (or the body it references via *-script-url) changed.
+func hashContent(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// fetchMetadataChange performs a recursive metadata GET that blocks until
+// the watched metadata subtree changes or timeout_sec elapses, returning the
+// attributes along with the etag to pass as last_etag on the next call.
+func fetchMetadataChange(ctx context.Context, lastEtag string) (map[string]string, string, error) {
+	client := &http.Client{Timeout: daemonWaitTimeout + defaultTimeout}
+
+	url := fmt.Sprintf("%s/?recursive=true&alt=json&wait_for_change=true&timeout_sec=%d&last_etag=%s",
+		metadataServer, int(daemonWaitTimeout.Seconds()), lastEtag)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, lastEtag, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	req = req.WithContext(ctx)
+
+	var body []byte
+	etag := lastEtag
+	err = retry(ctx, retryAttempts(), func() error {
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &httpStatusError{resp.StatusCode}
+		}
+		if e := resp.Header.Get("Etag"); e != "" {
+			etag = e
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		body = b
+		return nil
+	})
+	if err != nil {
+		return nil, lastEtag, err
+	}
+
+	var att map[string]string
+	if err := json.Unmarshal(body, &att); err != nil {
+		return nil, lastEtag, err
+	}
+	return att, etag, nil
+}
+
+// changedScripts filters mdss down to the scripts whose resolved content
+// differs from what's recorded in state, resolving *-script-url scripts to
+// their downloaded body first. state is updated in place with the new
+// hashes so the caller can persist it.
+func changedScripts(ctx context.Context, mdss []metadataScript, state map[string]string) []metadataScript {
+	var changed []metadataScript
+	for _, ms := range mdss {
+		runner, content := ms.RunnerName, ms.Script
+		if ms.RunnerName == urlScriptType {
+			name, script, err := resolveURLScript(ctx, &ms)
+			if err != nil {
+				logger.Error(fmt.Errorf("daemon: failed to resolve %s: %v", ms.Metadata, err))
+				continue
+			}
+			runner, content = name, script
+		}
+
+		hash := hashContent(content)
+		if state[ms.Metadata] == hash {
+			continue
+		}
+		state[ms.Metadata] = hash
+		changed = append(changed, metadataScript{runner, content, ms.Metadata})
+	}
+	return changed
+}
+
+// runDaemon long-polls the startup-script metadata keys and re-runs only
+// the scripts whose content changed since the last observation, without
+// requiring an instance restart. It returns when ctx is canceled, which
+// happens when the hosting Windows service is stopped.
+func runDaemon(ctx context.Context) error {
+	mdsm := map[string]string{}
+	for name, script := range scripts {
+		mdsm[name] = fmt.Sprintf(script, "windows-startup")
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	etag := "NONE"
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		att, newEtag, err := fetchMetadataChange(ctx, etag)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Error(fmt.Errorf("daemon: failed to poll metadata: %v", err))
+			// fetchMetadataChange already retried transient errors; this one
+			// was either non-retryable (e.g. a malformed response) or still
+			// failing once the retries ran out, so back off before polling
+			// again instead of busy-looping.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(initialBackoff):
+			}
+			continue
+		}
+		etag = newEtag
+
+		mdss := parseMetadata(mdsm, att)
+		changed := changedScripts(ctx, mdss, state)
+		if len(changed) == 0 {
+			continue
+		}
+
+		runScripts(ctx, changed)
+		if err := saveState(state); err != nil {
+			logger.Error(fmt.Errorf("daemon: failed to persist state: %v", err))
+		}
+	}
+}
@@ -0,0 +1,194 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+)
+
+const metadataInstanceServer = "http://metadata.google.internal/computeMetadata/v1/instance"
+
+// logURLRegex matches the gs://<bucket>/<prefix> form accepted by the
+// *-script-log-url metadata keys; prefix may be empty.
+var logURLRegex = regexp.MustCompile(fmt.Sprintf(`^gs://%s/(.*)$`, bucket))
+
+// scriptLogURLKey maps a script's metadata key (e.g.
+// "windows-startup-script-ps1") to the metadata key that, if set, points at
+// a gs:// prefix to stream its output to (e.g.
+// "windows-startup-script-log-url"). The suffix list is derived from the
+// registry plus the "url" fallback, so adding a ScriptRunner doesn't
+// silently break this mapping.
+func scriptLogURLKey(metadataKey string) string {
+	suffixes := make([]string, 0, len(registry)+1)
+	for name := range registry {
+		suffixes = append(suffixes, "-"+name)
+	}
+	suffixes = append(suffixes, "-"+urlScriptType)
+
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(metadataKey, suffix) {
+			return strings.TrimSuffix(metadataKey, suffix) + "-log-url"
+		}
+	}
+	return metadataKey + "-log-url"
+}
+
+// getMetadataAttribute fetches a single instance attribute, reporting
+// ok=false (not an error) if the key isn't set.
+func getMetadataAttribute(ctx context.Context, key string) (value string, ok bool, err error) {
+	req, err := http.NewRequest("GET", metadataServer+"/"+key, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+
+	client := &http.Client{Timeout: defaultTimeout}
+	err = retry(ctx, retryAttempts(), func() error {
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			ok = false
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &httpStatusError{resp.StatusCode}
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		value, ok = string(body), true
+		return nil
+	})
+	return value, ok, err
+}
+
+// instanceID returns this instance's numeric ID, used to namespace uploaded
+// script log objects.
+func instanceID(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("GET", metadataInstanceServer+"/id", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+
+	client := &http.Client{Timeout: defaultTimeout}
+	var id string
+	err = retry(ctx, retryAttempts(), func() error {
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &httpStatusError{resp.StatusCode}
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		id = strings.TrimSpace(string(body))
+		return nil
+	})
+	return id, err
+}
+
+// scriptLog buffers a script's output lines as they're produced, in
+// addition to the normal serial-port logging, and uploads the buffer as a
+// single GCS object once the script finishes. Buffering (rather than
+// streaming straight to a storage.Writer) is what lets Close retry the
+// whole upload on a fresh writer instead of replaying a half-sent,
+// already-failed one.
+type scriptLog struct {
+	client         *storage.Client
+	bucket, object string
+	buf            bytes.Buffer
+}
+
+// newScriptLog resolves the GCS object a script's log will be uploaded to
+// on Close: logURL is a gs://bucket/prefix/ value, and the object is named
+// "<instance-id>/<timestamp>-<script>.log".
+func newScriptLog(ctx context.Context, logURL, scriptName string) (*scriptLog, error) {
+	match := logURLRegex.FindStringSubmatch(logURL)
+	if len(match) != 3 {
+		return nil, fmt.Errorf("invalid script log url: %q", logURL)
+	}
+	bucket, prefix := match[1], match[2]
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	id, err := instanceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	object := fmt.Sprintf("%s%s/%d-%s.log", prefix, id, time.Now().Unix(), scriptName)
+	return &scriptLog{client: client, bucket: bucket, object: object}, nil
+}
+
+// WriteLine appends a line of script output to the log buffer.
+func (l *scriptLog) WriteLine(line string) {
+	l.buf.WriteString(line)
+	l.buf.WriteByte('\n')
+}
+
+// Close uploads the buffered output as the log object, annotated with the
+// script's exit code, name, and duration, retrying the whole upload (on a
+// fresh storage.Writer each attempt) on transient failures.
+func (l *scriptLog) Close(ctx context.Context, scriptName string, exitCode int, duration time.Duration) error {
+	defer l.client.Close()
+
+	meta := map[string]string{
+		"exit-code":   strconv.Itoa(exitCode),
+		"script-name": scriptName,
+		"duration":    duration.String(),
+	}
+	data := l.buf.Bytes()
+
+	return retry(ctx, retryAttempts(), func() error {
+		w := l.client.Bucket(l.bucket).Object(l.object).NewWriter(ctx)
+		w.Metadata = meta
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			logger.Infof("Failed to write script log %q: %v", l.object, err)
+			return err
+		}
+		if err := w.Close(); err != nil {
+			logger.Infof("Failed to upload script log %q: %v", l.object, err)
+			return err
+		}
+		return nil
+	})
+}
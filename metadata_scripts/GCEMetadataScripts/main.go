@@ -24,11 +24,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"syscall"
 	"time"
 
 	"strings"
@@ -41,14 +44,21 @@ var (
 	metadataServer = "http://metadata.google.internal/computeMetadata/v1/instance/attributes"
 	metadataHang   = "/?recursive=true&alt=json&timeout_sec=10&last_etag=NONE"
 	defaultTimeout = 20 * time.Second
-	commands       = []string{"specialize", "startup", "shutdown"}
-	scripts        = map[metadataScriptType]string{
-		ps1: "%s-script-ps1",
-		cmd: "%s-script-cmd",
-		bat: "%s-script-bat",
-		url: "%s-script-url",
+	commands       = []string{"specialize", "startup", "shutdown", "daemon"}
+	// scripts maps a ScriptRunner's registry name (plus the special "url"
+	// fallback) to its metadata-key format string. Run order is fixed by
+	// runOrder below, independent of map iteration order.
+	scripts = map[string]string{
+		"ps1": "%s-script-ps1",
+		"cmd": "%s-script-cmd",
+		"bat": "%s-script-bat",
+		"py":  "%s-script-py",
+		"url": "%s-script-url",
 	}
-	version string
+	// runOrder is the order scripts of different types run in, when more
+	// than one is set on the same instance.
+	runOrder = []string{"ps1", "cmd", "bat", "py", "url"}
+	version  string
 
 	bucket = `([a-z0-9][-_.a-z0-9]*)`
 	object = `(.+)`
@@ -74,73 +84,90 @@ var (
 	gsHTTPRegex3 = regexp.MustCompile(fmt.Sprintf(`^http[s]?://(?:commondata)?storage\.googleapis\.com/%s/%s$`, bucket, object))
 )
 
-const (
-	ps1 metadataScriptType = iota
-	cmd
-	bat
-	url
-)
-
-type metadataScriptType int
+// urlScriptType is the metadataScript.RunnerName used for the generic
+// *-script-url fallback: its Script field holds a URL rather than a script
+// body, and its real runner is resolved by urlExtRunnerName from the URL's
+// extension before the body is downloaded.
+const urlScriptType = "url"
 
 type metadataScript struct {
-	Type             metadataScriptType
+	RunnerName       string
 	Script, Metadata string
 }
 
 func (ms *metadataScript) run(ctx context.Context) error {
-	switch ms.Type {
-	case ps1:
-		return runPs1(ms)
-	case cmd:
-		return runBat(ms)
-	case bat:
-		return runBat(ms)
-	case url:
-		trimmed := strings.TrimSpace(ms.Script)
-		sType := trimmed[len(trimmed)-3 : len(trimmed)]
-		var st metadataScriptType
-		switch sType {
-		case "ps1":
-			st = ps1
-		case "cmd":
-			st = cmd
-		case "bat":
-			st = bat
-		default:
-			return fmt.Errorf("error getting script type from url path, path: %q, parsed type: %q", trimmed, sType)
-		}
-		script, err := downloadScript(ctx, trimmed)
+	if ms.RunnerName == urlScriptType {
+		runner, script, err := resolveURLScript(ctx, ms)
 		if err != nil {
 			return err
 		}
-		nMS := &metadataScript{st, script, ms.Metadata}
+		nMS := &metadataScript{runner, script, ms.Metadata}
 		return nMS.run(ctx)
-	default:
-		return fmt.Errorf("unknown script type: %q", ms.Script)
 	}
+
+	r, ok := registry[ms.RunnerName]
+	if !ok {
+		return fmt.Errorf("unknown script type: %q", ms.RunnerName)
+	}
+	return runScript(ctx, r, ms)
 }
 
-func downloadGSURL(ctx context.Context, bucket, object string) (string, error) {
-	client, err := storage.NewClient(ctx)
+// resolveURLScript resolves a urlScriptType metadataScript (whose Script
+// field holds a URL) into the registry name its body should run as plus
+// the downloaded body itself.
+func resolveURLScript(ctx context.Context, ms *metadataScript) (runnerName, script string, err error) {
+	trimmed := strings.TrimSpace(ms.Script)
+	runnerName, err = urlExtRunnerName(trimmed)
 	if err != nil {
-		return "", fmt.Errorf("failed to create client: %v", err)
+		return "", "", err
 	}
-	defer client.Close()
-
-	bkt := client.Bucket(bucket)
-	obj := bkt.Object(object)
-	r, err := obj.NewReader(ctx)
+	script, err = downloadScript(ctx, trimmed)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	defer r.Close()
+	return runnerName, script, nil
+}
 
-	var buf bytes.Buffer
-	if _, err := buf.ReadFrom(r); err != nil {
-		return "", err
+// urlExtRunnerName picks the registry entry to run a *-script-url script
+// with, based on the extension of the URL's path (ignoring any query
+// string or fragment).
+func urlExtRunnerName(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing script url %q: %v", rawURL, err)
+	}
+	ext := strings.TrimPrefix(path.Ext(u.Path), ".")
+	if _, ok := registry[ext]; !ok {
+		return "", fmt.Errorf("error getting script type from url path, path: %q, parsed type: %q", rawURL, ext)
 	}
-	return buf.String(), nil
+	return ext, nil
+}
+
+func downloadGSURL(ctx context.Context, bucket, object string) (string, error) {
+	var script string
+	err := retry(ctx, retryAttempts(), func() error {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create client: %v", err)
+		}
+		defer client.Close()
+
+		bkt := client.Bucket(bucket)
+		obj := bkt.Object(object)
+		r, err := obj.NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(r); err != nil {
+			return err
+		}
+		script = buf.String()
+		return nil
+	})
+	return script, err
 }
 
 func downloadScript(ctx context.Context, path string) (string, error) {
@@ -151,24 +178,70 @@ func downloadScript(ctx context.Context, path string) (string, error) {
 			return script, nil
 		}
 		logger.Infof("Failed to download GCS path: %v", err)
-		logger.Infof("Trying unauthenticated download", err)
+
+		logger.Infof("Trying authenticated HTTP download")
+		// path may be a gs://bucket/object URL (or another non-HTTP form
+		// findMatch accepts), which http.NewRequest can't fetch at all, so
+		// retry against the HTTPS form built from the already-parsed
+		// bucket/object rather than the original path.
+		httpsURL := fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, object)
+		script, err = downloadAuthenticatedURL(ctx, httpsURL)
+		if err == nil {
+			return script, nil
+		}
+		logger.Infof("Failed authenticated HTTP download: %v", err)
+		logger.Infof("Trying unauthenticated download")
 	}
 
 	// Fall back to unauthenticated download of the object.
-	return downloadURL(path)
+	return downloadURL(ctx, path)
 }
 
-func downloadURL(p string) (string, error) {
-	res, err := http.Get(p)
-	if err != nil {
-		return "", err
-	}
-	data, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
+func downloadURL(ctx context.Context, p string) (string, error) {
+	return doDownload(ctx, p, nil)
+}
+
+// downloadAuthenticatedURL fetches p with the instance's service-account
+// OAuth2 token attached, for objects in private buckets that client-library
+// access (downloadGSURL) couldn't reach. downloadScript passes the
+// https://storage.googleapis.com/<bucket>/<object> form for every GCS URL
+// form findMatch accepts.
+func downloadAuthenticatedURL(ctx context.Context, p string) (string, error) {
+	tok, err := serviceAccountToken(ctx)
 	if err != nil {
 		return "", err
 	}
-	return string(data), nil
+	header := http.Header{"Authorization": []string{tok.TokenType + " " + tok.AccessToken}}
+	return doDownload(ctx, p, header)
+}
+
+func doDownload(ctx context.Context, p string, header http.Header) (string, error) {
+	var data string
+	err := retry(ctx, retryAttempts(), func() error {
+		req, err := http.NewRequest("GET", p, nil)
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return &httpStatusError{res.StatusCode}
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		data = string(body)
+		return nil
+	})
+	return data, err
 }
 
 func findMatch(path string) (string, string) {
@@ -181,7 +254,7 @@ func findMatch(path string) (string, string) {
 	return "", ""
 }
 
-func getMetadata() (map[string]string, error) {
+func getMetadata(ctx context.Context) (map[string]string, error) {
 	client := &http.Client{
 		Timeout: defaultTimeout,
 	}
@@ -192,44 +265,53 @@ func getMetadata() (map[string]string, error) {
 	}
 	req.Header.Add("Metadata-Flavor", "Google")
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
+	var md []byte
+	err = retry(ctx, retryAttempts(), func() error {
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &httpStatusError{resp.StatusCode}
+		}
 
-	md, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		md = body
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+
 	var att map[string]string
 	return att, json.Unmarshal(md, &att)
 }
 
-func getScripts(mdsm map[metadataScriptType]string) ([]metadataScript, error) {
-	md, err := getMetadata()
+func getScripts(ctx context.Context, mdsm map[string]string) ([]metadataScript, error) {
+	md, err := getMetadata(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return parseMetadata(mdsm, md), nil
 }
 
-func parseMetadata(mdsm map[metadataScriptType]string, md map[string]string) []metadataScript {
+func parseMetadata(mdsm map[string]string, md map[string]string) []metadataScript {
 	var mdss []metadataScript
-	// Sort so we run scripts in order.
-	var keys []int
-	for k := range mdsm {
-		keys = append(keys, int(k))
-	}
-	sort.Ints(keys)
-	for _, k := range keys {
-		st := metadataScriptType(k)
-		name := mdsm[st]
+	// Run in runOrder, not map iteration order.
+	for _, runner := range runOrder {
+		name, ok := mdsm[runner]
+		if !ok {
+			continue
+		}
 		script, ok := md[name]
 		if !ok || script == "" {
 			continue
 		}
-		mdss = append(mdss, metadataScript{st, script, name})
+		mdss = append(mdss, metadataScript{runner, script, name})
 	}
 	return mdss
 }
@@ -250,7 +332,7 @@ func runScripts(ctx context.Context, scripts []metadataScript) {
 	}
 }
 
-func runCmd(c *exec.Cmd, name string) error {
+func runCmd(ctx context.Context, c *exec.Cmd, ms *metadataScript) error {
 	pr, pw, err := os.Pipe()
 	if err != nil {
 		return err
@@ -260,38 +342,56 @@ func runCmd(c *exec.Cmd, name string) error {
 	c.Stdout = pw
 	c.Stderr = pw
 
+	start := time.Now()
 	if err := c.Start(); err != nil {
 		return err
 	}
 	pw.Close()
 
+	var log *scriptLog
+	if logURL, ok, err := getMetadataAttribute(ctx, scriptLogURLKey(ms.Metadata)); err != nil {
+		logger.Infof("Failed to look up %s: %v", scriptLogURLKey(ms.Metadata), err)
+	} else if ok && logURL != "" {
+		log, err = newScriptLog(ctx, logURL, ms.Metadata)
+		if err != nil {
+			logger.Infof("Failed to open script log %q: %v", logURL, err)
+			log = nil
+		}
+	}
+
+	name := ms.Metadata
 	in := bufio.NewScanner(pr)
 	for in.Scan() {
-		logger.Log.Output(3, name+": "+in.Text())
+		line := in.Text()
+		logger.Log.Output(3, name+": "+line)
+		if log != nil {
+			log.WriteLine(line)
+		}
 	}
 
-	return c.Wait()
-}
+	waitErr := c.Wait()
 
-func runBat(ms *metadataScript) error {
-	tmpFile, err := tempFile(ms.Metadata+".bat", ms.Script)
-	if err != nil {
-		return err
+	if log != nil {
+		exitCode := 0
+		if exitErr, ok := waitErr.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		}
+		if err := log.Close(ctx, name, exitCode, time.Since(start)); err != nil {
+			logger.Infof("Failed to finalize script log: %v", err)
+		}
 	}
-	defer os.RemoveAll(filepath.Dir(tmpFile))
 
-	return runCmd(exec.Command(tmpFile), ms.Metadata)
+	return waitErr
 }
 
-func runPs1(ms *metadataScript) error {
-	tmpFile, err := tempFile(ms.Metadata+".ps1", ms.Script)
+func runScript(ctx context.Context, r ScriptRunner, ms *metadataScript) error {
+	tmpFile, err := tempFile(ms.Metadata+"."+r.Extension(), ms.Script)
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(filepath.Dir(tmpFile))
 
-	c := exec.Command("powershell.exe", "-NoProfile", "-NoLogo", "-ExecutionPolicy", "Unrestricted", "-File", tmpFile)
-	return runCmd(c, ms.Metadata)
+	return runCmd(ctx, r.Command(tmpFile), ms)
 }
 
 func tempFile(name, content string) (string, error) {
@@ -304,13 +404,18 @@ func tempFile(name, content string) (string, error) {
 	return tmpFile, ioutil.WriteFile(tmpFile, []byte(content), 0666)
 }
 
-func validateArgs(args []string) (map[metadataScriptType]string, error) {
+func validateArgs(args []string) (map[string]string, error) {
 	if len(args) != 2 {
 		return nil, fmt.Errorf("No valid arguments specified. Options: %s", commands)
 	}
+	if args[1] == "daemon" {
+		// daemon has no fixed metadata-key set: it long-polls and resolves
+		// windows-startup-script-* keys itself, see runDaemon.
+		return nil, nil
+	}
 	for _, command := range commands {
 		if command == args[1] {
-			mdsm := map[metadataScriptType]string{}
+			mdsm := map[string]string{}
 			if command == "specialize" {
 				command = "sysprep-" + command
 			} else {
@@ -335,7 +440,25 @@ func main() {
 
 	logger.Infof("Starting %s scripts (verison %s).", os.Args[1], version)
 
-	scripts, err := getScripts(metadata)
+	ctx := context.Background()
+	if os.Args[1] == "daemon" {
+		ctx, stop := context.WithCancel(ctx)
+		// Cancel on a service stop signal so the long-poll loop exits
+		// cleanly instead of being killed mid-request.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			stop()
+		}()
+
+		if err := runDaemon(ctx); err != nil && err != context.Canceled {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	scripts, err := getScripts(ctx, metadata)
 	if err != nil {
 		fmt.Println(err)
 		logger.Fatal(err)
@@ -346,7 +469,6 @@ func main() {
 		os.Exit(0)
 	}
 
-	ctx := context.Background()
 	runScripts(ctx, scripts)
 	logger.Infof("Finished running %s scripts.", os.Args[1])
 }
@@ -0,0 +1,144 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	retryAttemptsKey     = "metadata-script-retry-attempts"
+	defaultRetryAttempts = 5
+
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 30 * time.Second
+	maxRetryTime   = 5 * time.Minute
+)
+
+// httpStatusError wraps a non-2xx HTTP response so it can be classified by
+// isRetryable.
+type httpStatusError struct {
+	statusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status: %d", e.statusCode)
+}
+
+// isRetryable reports whether err represents a transient failure worth
+// retrying: HTTP 5xx/429, a deadline exceeded, or a network-level error.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if statusErr, ok := err.(*httpStatusError); ok {
+		return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= 500
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	if uerr, ok := err.(*url.Error); ok {
+		return isRetryable(uerr.Err)
+	}
+	return false
+}
+
+// retry runs fn, retrying up to maxAttempts times while isRetryable(err) is
+// true, sleeping with exponential backoff and jitter between attempts
+// (starting at initialBackoff, capped at maxBackoff). It gives up early if
+// ctx is done or the cumulative sleep time exceeds maxRetryTime.
+func retry(ctx context.Context, maxAttempts int, fn func() error) error {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	backoff := initialBackoff
+	var slept time.Duration
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if attempt == maxAttempts || !isRetryable(err) || slept >= maxRetryTime {
+			return err
+		}
+
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+		logger.Infof("Retryable error, attempt %d/%d, sleeping %v: %v", attempt, maxAttempts, sleep, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+		slept += sleep
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	return err
+}
+
+// retryAttempts returns the configured max-attempts for the retry helper,
+// read from the metadata-script-retry-attempts instance metadata key,
+// falling back to defaultRetryAttempts if it is unset or invalid.
+func retryAttempts() int {
+	req, err := http.NewRequest("GET", metadataServer+"/"+retryAttemptsKey, nil)
+	if err != nil {
+		return defaultRetryAttempts
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+
+	client := &http.Client{Timeout: defaultTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return defaultRetryAttempts
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return defaultRetryAttempts
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return defaultRetryAttempts
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil || n < 1 {
+		return defaultRetryAttempts
+	}
+	return n
+}
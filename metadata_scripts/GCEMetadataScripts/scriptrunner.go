@@ -0,0 +1,74 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import "os/exec"
+
+// ScriptRunner knows how to turn a downloaded/inline script body into a
+// runnable command. Built-in runners are registered below; Register lets
+// callers add support for additional interpreters without touching
+// metadataScript.run.
+type ScriptRunner interface {
+	// Extension is the file extension (no leading dot) tempFile should use
+	// for scripts of this type. Registry lookups use the name passed to
+	// Register, which need not equal Extension (e.g. "cmd" maps to a runner
+	// whose Extension is "bat").
+	Extension() string
+	// Command returns the exec.Cmd that runs the script stored at tmpFile.
+	Command(tmpFile string) *exec.Cmd
+}
+
+var registry = map[string]ScriptRunner{}
+
+// Register adds (or replaces) the ScriptRunner used for scripts whose
+// metadata suffix or URL extension is name.
+func Register(name string, r ScriptRunner) {
+	registry[name] = r
+}
+
+func init() {
+	Register("ps1", ps1Runner{})
+	Register("cmd", batRunner{})
+	Register("bat", batRunner{})
+	Register("py", pythonRunner{})
+	Register("python", pythonRunner{})
+}
+
+type ps1Runner struct{}
+
+func (ps1Runner) Extension() string { return "ps1" }
+
+func (ps1Runner) Command(tmpFile string) *exec.Cmd {
+	return exec.Command("powershell.exe", "-NoProfile", "-NoLogo", "-ExecutionPolicy", "Unrestricted", "-File", tmpFile)
+}
+
+// batRunner handles both the "cmd" and "bat" metadata suffixes: both are
+// plain Windows batch files, just surfaced under different metadata keys.
+type batRunner struct{}
+
+func (batRunner) Extension() string { return "bat" }
+
+func (batRunner) Command(tmpFile string) *exec.Cmd {
+	return exec.Command(tmpFile)
+}
+
+// pythonRunner invokes python.exe, which must be present on PATH.
+type pythonRunner struct{}
+
+func (pythonRunner) Extension() string { return "py" }
+
+func (pythonRunner) Command(tmpFile string) *exec.Cmd {
+	return exec.Command("python.exe", tmpFile)
+}
@@ -0,0 +1,87 @@
+//  Copyright 2017 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// tokenExpiryMargin is subtracted from the token's reported expiry so we
+	// refresh slightly before the metadata server actually invalidates it.
+	tokenExpiryMargin = 30 * time.Second
+)
+
+type accessToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+var (
+	tokenMu     sync.Mutex
+	cachedToken accessToken
+	tokenExpiry time.Time
+)
+
+// serviceAccountToken returns the instance's default service-account OAuth2
+// access token, fetching a fresh one from the metadata server and caching
+// it until shortly before it expires.
+func serviceAccountToken(ctx context.Context) (accessToken, error) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+
+	if cachedToken.AccessToken != "" && time.Now().Before(tokenExpiry) {
+		return cachedToken, nil
+	}
+
+	req, err := http.NewRequest("GET", serviceAccountTokenURL, nil)
+	if err != nil {
+		return accessToken{}, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+
+	client := &http.Client{Timeout: defaultTimeout}
+	var tok accessToken
+	err = retry(ctx, retryAttempts(), func() error {
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &httpStatusError{resp.StatusCode}
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(body, &tok)
+	})
+	if err != nil {
+		return accessToken{}, err
+	}
+
+	cachedToken = tok
+	tokenExpiry = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return cachedToken, nil
+}